@@ -6,18 +6,27 @@ package drivechain
 */
 import "C"
 import (
+	"context"
 	"crypto/ecdsa"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"math/big"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"unsafe"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/holiman/uint256"
 )
 
 const THIS_SIDECHAIN = 1
@@ -37,7 +46,7 @@ const TREASURY_PRIVATE_KEY = "deadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeefde
 const TREASURY_ACCOUNT = "0xc96aaa54e2d44c299564da76e1cd3184a2386b8d"
 
 // There are 10,000,000,000 Wei in one Satoshi
-var Satoshi = big.NewInt(10_000_000_000)
+var Satoshi = uint256.NewInt(10_000_000_000)
 
 // There are 10^8 satoshi in one BTC
 // There are 10^18 Wei in one Ether.
@@ -46,6 +55,42 @@ var Satoshi = big.NewInt(10_000_000_000)
 //
 // So there should be 21 * 10 ^ 6 * 10 ^ 18 = 21 * 10^24 "Wei" in the treasury account.
 
+// Backend abstracts the drivechain operations that otherwise cross the CGo
+// boundary into libdrivechain_eth and out to a live bitcoind over RPC. This
+// lets everything built on top of the sidechain (the miner's BMM loop, the
+// state processor's deposit/withdrawal crediting) be unit tested against
+// the simulated package's in-memory implementation instead.
+type Backend interface {
+	GetMainchainTip() common.Hash
+	GetPrevMainBlockHash(mainBlockHash common.Hash) common.Hash
+	GetDepositOutputs() []Deposit
+	ConnectBlock(mainBlockHash common.Hash, deposits []Deposit, withdrawals map[common.Hash]Withdrawal, refunds []common.Hash, justChecking bool) bool
+	DisconnectBlock(mainBlockHash common.Hash) error
+	Rewind(ancestor common.Hash) ([]Deposit, map[common.Hash]Withdrawal, []common.Hash, error)
+	AttemptBmm(sessionID uint64, header *types.Header, amount uint64)
+	ConfirmBmm(sessionID uint64) BmmState
+	AbortBmm(sessionID uint64)
+	VerifyBmm(mainBlockHash common.Hash, criticalHash common.Hash) bool
+	AttemptBundleBroadcast() bool
+	CreateDeposit(address common.Address, amount uint64, fee uint64) bool
+	FormatDepositAddress(address string) string
+	GetNewMainchainAddress() common.Address
+}
+
+// defaultBackend is what the package-level functions below dispatch to. It
+// is a CgoBackend in production; tests and anything built on the simulated
+// package swap it out with SetBackend.
+var defaultBackend Backend = NewCgoBackend()
+
+// SetBackend overrides the package-level default backend and returns the
+// previous one, so callers (tests, mainly) can restore it afterwards.
+// Production code should not need to call this.
+func SetBackend(b Backend) Backend {
+	previous := defaultBackend
+	defaultBackend = b
+	return previous
+}
+
 func Init(dbPath, rpcUser, rpcPassword string) {
 	privKey, err := crypto.HexToECDSA(TREASURY_PRIVATE_KEY)
 	if err != nil {
@@ -65,14 +110,362 @@ func Init(dbPath, rpcUser, rpcPassword string) {
 	C.free(unsafe.Pointer(cRpcPassword))
 }
 
-func GetMainchainTip() common.Hash {
+func GetMainchainTip() common.Hash { return defaultBackend.GetMainchainTip() }
+
+func GetPrevMainBlockHash(mainBlockHash common.Hash) common.Hash {
+	return defaultBackend.GetPrevMainBlockHash(mainBlockHash)
+}
+
+// amountToC marshals a Wei amount into the four-limb Amount struct that
+// crosses the CGo boundary, via the canonical big-endian Bytes32 encoding.
+func amountToC(amount *uint256.Int) C.Amount {
+	b := amount.Bytes32()
+	return C.Amount{
+		limb0: C.ulong(binary.BigEndian.Uint64(b[0:8])),
+		limb1: C.ulong(binary.BigEndian.Uint64(b[8:16])),
+		limb2: C.ulong(binary.BigEndian.Uint64(b[16:24])),
+		limb3: C.ulong(binary.BigEndian.Uint64(b[24:32])),
+	}
+}
+
+// amountFromC is the inverse of amountToC.
+func amountFromC(amount C.Amount) *uint256.Int {
+	var b [32]byte
+	binary.BigEndian.PutUint64(b[0:8], uint64(amount.limb0))
+	binary.BigEndian.PutUint64(b[8:16], uint64(amount.limb1))
+	binary.BigEndian.PutUint64(b[16:24], uint64(amount.limb2))
+	binary.BigEndian.PutUint64(b[24:32], uint64(amount.limb3))
+	return new(uint256.Int).SetBytes32(b[:])
+}
+
+type RawDeposit struct {
+	address string
+	amount  *uint256.Int
+}
+
+type Deposit struct {
+	Address common.Address
+	Amount  *uint256.Int
+}
+
+// Withdrawal is a pending transfer of value from the sidechain back to
+// mainchain. Its destination address reuses common.Address purely as a
+// 20-byte container for a mainchain P2PKH/P2WPKH pubkey hash; it is not an
+// Ethereum account and its fields stay unexported so that the CGo boundary
+// ([20]C.uchar, C.Amount) never leaks into callers that construct or
+// inspect withdrawals (miners, RPC, tests).
+type Withdrawal struct {
+	address common.Address
+	amount  *uint256.Int
+	fee     *big.Int
+}
+
+// WithdrawalFromBytes builds a Withdrawal from a raw mainchain address,
+// rejecting malformed input with an error instead of truncating or
+// zero-padding it.
+func WithdrawalFromBytes(address []byte, amount *uint256.Int, fee *big.Int) (Withdrawal, error) {
+	if len(address) != 20 {
+		return Withdrawal{}, fmt.Errorf("mainchain address must be 20 bytes, got %d", len(address))
+	}
+	return Withdrawal{
+		address: common.BytesToAddress(address),
+		amount:  amount,
+		fee:     fee,
+	}, nil
+}
+
+// MainchainAddress returns the withdrawal's destination mainchain address.
+func (w Withdrawal) MainchainAddress() common.Address {
+	return w.address
+}
+
+// Amount returns the withdrawal amount, denominated in Satoshi.
+func (w Withdrawal) Amount() *uint256.Int {
+	return w.amount
+}
+
+// Fee returns the mainchain transaction fee, denominated in Satoshi.
+func (w Withdrawal) Fee() *big.Int {
+	return w.fee
+}
+
+// withdrawalMarshaling is the exported shadow of Withdrawal used to encode
+// and decode it without making its own fields public.
+type withdrawalMarshaling struct {
+	Address common.Address
+	Amount  *uint256.Int
+	Fee     *big.Int
+}
+
+func (w Withdrawal) EncodeRLP(out io.Writer) error {
+	return rlp.Encode(out, withdrawalMarshaling{Address: w.address, Amount: w.amount, Fee: w.fee})
+}
+
+func (w *Withdrawal) DecodeRLP(s *rlp.Stream) error {
+	var dec withdrawalMarshaling
+	if err := s.Decode(&dec); err != nil {
+		return err
+	}
+	w.address, w.amount, w.fee = dec.Address, dec.Amount, dec.Fee
+	return nil
+}
+
+func (w Withdrawal) MarshalJSON() ([]byte, error) {
+	return json.Marshal(withdrawalMarshaling{Address: w.address, Amount: w.amount, Fee: w.fee})
+}
+
+func (w *Withdrawal) UnmarshalJSON(data []byte) error {
+	var dec withdrawalMarshaling
+	if err := json.Unmarshal(data, &dec); err != nil {
+		return err
+	}
+	w.address, w.amount, w.fee = dec.Address, dec.Amount, dec.Fee
+	return nil
+}
+
+// addressToC marshals a mainchain address into the fixed-size byte array
+// the C.Withdrawal struct carries it as.
+func addressToC(address common.Address) [20]C.uchar {
+	var out [20]C.uchar
+	for i, b := range address.Bytes() {
+		out[i] = C.uchar(b)
+	}
+	return out
+}
+
+func GetDepositOutputs() []Deposit { return defaultBackend.GetDepositOutputs() }
+
+// common.Hash for withdrawals/refunds here is for transaction hashes.
+// mainBlockHash is the mainchain block these deposits/withdrawals/refunds
+// were confirmed in; it is the key DisconnectBlock later undoes this call
+// by.
+func ConnectBlock(mainBlockHash common.Hash, deposits []Deposit, withdrawals map[common.Hash]Withdrawal, refunds []common.Hash, justChecking bool) bool {
+	return defaultBackend.ConnectBlock(mainBlockHash, deposits, withdrawals, refunds, justChecking)
+}
+
+// DisconnectBlock undoes a previous ConnectBlock call for mainBlockHash, so
+// that a mainchain reorg (which BMM sidechains must tolerate, since
+// critical-hash inclusion lives on Bitcoin) can be unwound symmetrically.
+// It is an error to disconnect anything but the most recently connected
+// block.
+func DisconnectBlock(mainBlockHash common.Hash) error {
+	return defaultBackend.DisconnectBlock(mainBlockHash)
+}
+
+// Rewind disconnects every connected block back to (but not including)
+// ancestor, and returns the deposits, withdrawals, and refunds that were
+// reverted, so the EVM state processor can refund/reapply balances
+// symmetrically with how they were first applied.
+func Rewind(ancestor common.Hash) ([]Deposit, map[common.Hash]Withdrawal, []common.Hash, error) {
+	return defaultBackend.Rewind(ancestor)
+}
+
+// MainchainAncestor walks the previous-block-hash chain from both a and b
+// until it finds their common ancestor, the way two diverging mainchain
+// forks share a most-recent common block. It returns the zero hash if no
+// common ancestor is found before either side reaches the zero hash.
+func MainchainAncestor(a, b common.Hash) common.Hash {
+	seen := make(map[common.Hash]bool)
+	for h := a; h != (common.Hash{}); h = defaultBackend.GetPrevMainBlockHash(h) {
+		seen[h] = true
+	}
+	for h := b; h != (common.Hash{}); h = defaultBackend.GetPrevMainBlockHash(h) {
+		if seen[h] {
+			return h
+		}
+	}
+	return common.Hash{}
+}
+
+func FormatDepositAddress(address string) string { return defaultBackend.FormatDepositAddress(address) }
+
+func CreateDeposit(address common.Address, amount uint64, fee uint64) bool {
+	return defaultBackend.CreateDeposit(address, amount, fee)
+}
+
+func GetWithdrawalData(fee uint64) []byte {
+	feeBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(feeBytes, fee)
+	address := defaultBackend.GetNewMainchainAddress()
+	return append(feeBytes, address.Bytes()...)
+}
+
+func DecodeWithdrawal(value *big.Int, data []byte) (Withdrawal, error) {
+	if len(data) != 28 {
+		return Withdrawal{}, errors.New("wrong withdrawal data length")
+	}
+	feeBytes := data[0:8]
+	if len(feeBytes) != 8 {
+		panic("off by one error")
+	}
+	addressBytes := data[8:28]
+	if len(addressBytes) != 20 {
+		panic("off by one error")
+	}
+	// Convert Wei to Satoshi.
+	weiValue, overflow := uint256.FromBig(value)
+	if overflow {
+		return Withdrawal{}, errors.New("withdrawal value overflows uint256")
+	}
+	var amount uint256.Int
+	amount.Div(weiValue, Satoshi)
+	if !amount.IsUint64() {
+		return Withdrawal{}, fmt.Errorf("withdrawal amount %s satoshi exceeds mainchain uint64 range (max %d)", amount.Dec(), uint64(math.MaxUint64))
+	}
+	fee := big.NewInt(int64(binary.BigEndian.Uint64(feeBytes)))
+	return WithdrawalFromBytes(addressBytes, &amount, fee)
+}
+
+func AttemptBundleBroadcast() bool { return defaultBackend.AttemptBundleBroadcast() }
+
+// legacyBmmSessionID is the session id used by the deprecated package-level
+// AttemptBmm/ConfirmBmm pair, which predates per-session BMM attempts and so
+// has no session of its own to key off of.
+const legacyBmmSessionID = 0
+
+// Deprecated: use StartBmm, which returns a cancellable *BmmSession instead
+// of relying on this package-level implicit attempt.
+func AttemptBmm(header *types.Header, amount uint64) {
+	defaultBackend.AttemptBmm(legacyBmmSessionID, header, amount)
+}
+
+type BmmState uint
+
+const (
+	Succeded BmmState = iota
+	Failed
+	Pending
+)
+
+// Deprecated: use (*BmmSession).Wait, returned by StartBmm, instead of
+// polling this package-level implicit attempt.
+func ConfirmBmm() BmmState { return defaultBackend.ConfirmBmm(legacyBmmSessionID) }
+
+// bmmSessionCounter hands out the session ids StartBmm uses to key its
+// AttemptBmm/ConfirmBmm/AbortBmm calls, so that two concurrent sessions
+// (e.g. attempts against competing fork-choice candidates) never observe or
+// abort each other's in-flight attempt.
+var bmmSessionCounter uint64 = legacyBmmSessionID
+
+func nextBmmSessionID() uint64 {
+	return atomic.AddUint64(&bmmSessionCounter, 1)
+}
+
+// BmmSession is a single in-flight, cancellable BMM attempt, returned by
+// StartBmm.
+type BmmSession struct {
+	hash common.Hash
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu    sync.Mutex
+	state BmmState
+}
+
+// Hash returns the critical hash this session is attempting to include.
+func (s *BmmSession) Hash() common.Hash {
+	return s.hash
+}
+
+// Wait blocks until the BMM attempt settles, including settling to Failed
+// if the session was cancelled, and returns its final state.
+func (s *BmmSession) Wait() BmmState {
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// Cancel abandons a stale BMM attempt, e.g. because a new side-block
+// arrived and made this session's critical hash obsolete. It tells the
+// backend to abort without waiting for the in-flight attempt to unwind.
+func (s *BmmSession) Cancel() {
+	s.cancel()
+}
+
+// StartBmm starts a BMM attempt against header without blocking the
+// caller, so a miner can run speculative attempts on multiple fork-choice
+// candidates in parallel and abandon whichever ones a new side-block makes
+// stale. Each session gets its own session id, so one session's Cancel or
+// poll never observes or aborts another session's in-flight attempt, even
+// though attempt_bmm/confirm_bmm are blocking CGo calls serialized by a
+// Rust-side lock; the attempt runs on a dedicated OS thread
+// (runtime.LockOSThread) and is polled via ConfirmBmm from there;
+// cancellation doesn't have to interrupt CGo itself, it just tells the
+// backend to post an abort that the Rust side polls for between RPC steps.
+func StartBmm(ctx context.Context, header *types.Header, amount uint64) (*BmmSession, error) {
+	sessionID := nextBmmSessionID()
+	ctx, cancel := context.WithCancel(ctx)
+	session := &BmmSession{
+		hash:   header.Hash(),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		defer close(session.done)
+
+		defaultBackend.AttemptBmm(sessionID, header, amount)
+
+		var state BmmState
+	poll:
+		for {
+			select {
+			case <-ctx.Done():
+				defaultBackend.AbortBmm(sessionID)
+				state = Failed
+				break poll
+			default:
+			}
+			state = defaultBackend.ConfirmBmm(sessionID)
+			if state != Pending {
+				break poll
+			}
+		}
+
+		session.mu.Lock()
+		session.state = state
+		session.mu.Unlock()
+	}()
+	return session, nil
+}
+
+func VerifyBmm(mainBlockHash common.Hash, criticalHash common.Hash) bool {
+	return defaultBackend.VerifyBmm(mainBlockHash, criticalHash)
+}
+
+// connectBlockEntry is an undo record for a single ConnectBlock call. It
+// mirrors the core/state journal pattern: DisconnectBlock pops entries in
+// LIFO order and reverses the mutation each one recorded.
+type connectBlockEntry struct {
+	mainBlockHash common.Hash
+	deposits      []Deposit
+	withdrawals   map[common.Hash]Withdrawal
+	refunds       []common.Hash
+}
+
+// CgoBackend is the Backend implementation that talks to a live bitcoind
+// through libdrivechain_eth.a via CGo. It is the implementation used in
+// production; SetBackend is how tests swap it out.
+type CgoBackend struct {
+	mu      sync.Mutex
+	journal []connectBlockEntry
+}
+
+func NewCgoBackend() *CgoBackend {
+	return &CgoBackend{}
+}
+
+func (b *CgoBackend) GetMainchainTip() common.Hash {
 	var cMainchainTip = C.get_mainchain_tip()
 	var mainchainTip = C.GoString(cMainchainTip)
 	C.free_string(cMainchainTip)
 	return common.HexToHash(mainchainTip)
 }
 
-func GetPrevMainBlockHash(mainBlockHash common.Hash) common.Hash {
+func (b *CgoBackend) GetPrevMainBlockHash(mainBlockHash common.Hash) common.Hash {
 	var cMainBlockHash = C.CString(mainBlockHash.Hex()[2:])
 	var cPrevMainBlockHash = C.get_prev_main_block_hash(cMainBlockHash)
 	var prevMainBlockHash = C.GoString(cPrevMainBlockHash)
@@ -81,19 +474,14 @@ func GetPrevMainBlockHash(mainBlockHash common.Hash) common.Hash {
 	return common.HexToHash(prevMainBlockHash)
 }
 
-type RawDeposit struct {
-	address string
-	amount  uint64
-}
-
-func getDepositOutputs() []RawDeposit {
+func (b *CgoBackend) getDepositOutputs() []RawDeposit {
 	ptrDeposits := C.get_deposit_outputs()
 	cDeposits := unsafe.Slice(ptrDeposits.ptr, ptrDeposits.len)
 	deposits := make([]RawDeposit, 0, ptrDeposits.len)
 	for _, cDeposit := range cDeposits {
 		deposit := RawDeposit{
 			address: C.GoString(cDeposit.address),
-			amount:  uint64(cDeposit.amount),
+			amount:  amountFromC(cDeposit.amount),
 		}
 		deposits = append(deposits, deposit)
 	}
@@ -101,37 +489,25 @@ func getDepositOutputs() []RawDeposit {
 	return deposits
 }
 
-type Deposit struct {
-	Address common.Address
-	Amount  *big.Int
-}
-
-type Withdrawal struct {
-	Address [20]C.uchar
-	Amount  *big.Int
-	Fee     *big.Int
-}
-
-func GetDepositOutputs() []Deposit {
-	rawDeposits := getDepositOutputs()
+func (b *CgoBackend) GetDepositOutputs() []Deposit {
+	rawDeposits := b.getDepositOutputs()
 	deposits := make([]Deposit, 0, len(rawDeposits))
 	for _, rawDeposit := range rawDeposits {
 		deposits = append(deposits, Deposit{
 			Address: common.HexToAddress(rawDeposit.address),
-			Amount:  big.NewInt(int64(rawDeposit.amount)),
+			Amount:  rawDeposit.amount,
 		})
 	}
 	return deposits
 }
 
-// common.Hash here is for transaction hashes.
-func ConnectBlock(deposits []Deposit, withdrawals map[common.Hash]Withdrawal, refunds []common.Hash, just_checking bool) bool {
+func (b *CgoBackend) ConnectBlock(mainBlockHash common.Hash, deposits []Deposit, withdrawals map[common.Hash]Withdrawal, refunds []common.Hash, justChecking bool) bool {
 	depositsMemory := C.malloc(C.size_t(len(deposits)) * C.size_t(unsafe.Sizeof(C.Deposit{})))
 	depositsSlice := (*[1<<30 - 1]C.Deposit)(depositsMemory)
 	for i, deposit := range deposits {
 		cDeposit := C.Deposit{
 			address: C.CString(strings.ToLower(deposit.Address.String())),
-			amount:  C.ulong(deposit.Amount.Uint64()),
+			amount:  amountToC(deposit.Amount),
 		}
 		depositsSlice[i] = cDeposit
 	}
@@ -147,9 +523,9 @@ func ConnectBlock(deposits []Deposit, withdrawals map[common.Hash]Withdrawal, re
 			log.Info(fmt.Sprintf("wtid = %s", id.Hex()))
 			cWithdrawal := C.Withdrawal{
 				id:      C.CString(id.Hex()),
-				address: w.Address,
-				amount:  C.ulong(w.Amount.Uint64()),
-				fee:     C.ulong(w.Fee.Uint64()),
+				address: addressToC(w.address),
+				amount:  amountToC(w.amount),
+				fee:     C.ulong(w.fee.Uint64()),
 			}
 			withdrawalsSlice[i] = cWithdrawal
 			i += 1
@@ -172,10 +548,93 @@ func ConnectBlock(deposits []Deposit, withdrawals map[common.Hash]Withdrawal, re
 		ptr: &refundsSlice[0],
 		len: C.ulong(len(refunds)),
 	}
-	return bool(C.connect_block(cDeposits, cWithdrawals, cRefunds, C.bool(just_checking)))
+	ok := bool(C.connect_block(cDeposits, cWithdrawals, cRefunds, C.bool(justChecking)))
+	if ok && !justChecking {
+		withdrawalsCopy := make(map[common.Hash]Withdrawal, len(withdrawals))
+		for id, w := range withdrawals {
+			withdrawalsCopy[id] = w
+		}
+		b.mu.Lock()
+		b.journal = append(b.journal, connectBlockEntry{
+			mainBlockHash: mainBlockHash,
+			deposits:      append([]Deposit(nil), deposits...),
+			withdrawals:   withdrawalsCopy,
+			refunds:       append([]common.Hash(nil), refunds...),
+		})
+		b.mu.Unlock()
+	}
+	return ok
 }
 
-func FormatDepositAddress(address string) string {
+// DisconnectBlock undoes the effects of a previously connected mainchain
+// block: it pops the top journal entry (returning an error if mainBlockHash
+// isn't the most recently connected one) and asks the Rust side to reverse
+// the corresponding deposit/withdrawal/refund mutations.
+func (b *CgoBackend) DisconnectBlock(mainBlockHash common.Hash) error {
+	b.mu.Lock()
+	if len(b.journal) == 0 {
+		b.mu.Unlock()
+		return fmt.Errorf("drivechain: no connected block to disconnect")
+	}
+	top := b.journal[len(b.journal)-1]
+	if top.mainBlockHash != mainBlockHash {
+		b.mu.Unlock()
+		return fmt.Errorf("drivechain: %s is not the most recently connected block (%s is)", mainBlockHash.Hex(), top.mainBlockHash.Hex())
+	}
+	b.mu.Unlock()
+
+	cMainBlockHash := C.CString(mainBlockHash.Hex()[2:])
+	ok := bool(C.disconnect_block(cMainBlockHash))
+	C.free(unsafe.Pointer(cMainBlockHash))
+	if !ok {
+		return fmt.Errorf("drivechain: disconnect_block failed for %s", mainBlockHash.Hex())
+	}
+
+	b.mu.Lock()
+	b.journal = b.journal[:len(b.journal)-1]
+	b.mu.Unlock()
+	return nil
+}
+
+// Rewind disconnects journaled blocks back to (but not including) ancestor,
+// returning the deposits, withdrawals, and refunds that were reverted along
+// the way.
+//
+// Progress is tracked purely off the journal, not GetMainchainTip: by the
+// time a real mainchain reorg calls Rewind, bitcoind's live tip has already
+// moved to the new fork, so it would never equal ancestor and this would
+// drain the whole journal on every call.
+func (b *CgoBackend) Rewind(ancestor common.Hash) ([]Deposit, map[common.Hash]Withdrawal, []common.Hash, error) {
+	var (
+		deposits    []Deposit
+		withdrawals = make(map[common.Hash]Withdrawal)
+		refunds     []common.Hash
+	)
+	for {
+		b.mu.Lock()
+		if len(b.journal) == 0 {
+			b.mu.Unlock()
+			return nil, nil, nil, fmt.Errorf("drivechain: %s is not an ancestor of the connected chain", ancestor.Hex())
+		}
+		entry := b.journal[len(b.journal)-1]
+		if entry.mainBlockHash == ancestor {
+			b.mu.Unlock()
+			return deposits, withdrawals, refunds, nil
+		}
+		b.mu.Unlock()
+
+		if err := b.DisconnectBlock(entry.mainBlockHash); err != nil {
+			return nil, nil, nil, err
+		}
+		deposits = append(deposits, entry.deposits...)
+		for id, w := range entry.withdrawals {
+			withdrawals[id] = w
+		}
+		refunds = append(refunds, entry.refunds...)
+	}
+}
+
+func (b *CgoBackend) FormatDepositAddress(address string) string {
 	cAddress := C.CString(address)
 	cDepositAddress := C.format_deposit_address(cAddress)
 	depositAddress := C.GoString(cDepositAddress)
@@ -184,7 +643,7 @@ func FormatDepositAddress(address string) string {
 	return depositAddress
 }
 
-func CreateDeposit(address common.Address, amount uint64, fee uint64) bool {
+func (b *CgoBackend) CreateDeposit(address common.Address, amount uint64, fee uint64) bool {
 	cAddress := C.CString(strings.ToLower(address.Hex()))
 	cAmount := C.ulong(amount)
 	cFee := C.ulong(fee)
@@ -193,81 +652,43 @@ func CreateDeposit(address common.Address, amount uint64, fee uint64) bool {
 	return bool(result)
 }
 
-func GetWithdrawalData(fee uint64) []byte {
-	feeBytes := make([]byte, 8)
-	binary.BigEndian.PutUint64(feeBytes, fee)
-	addressBytes := make([]byte, 20)
+func (b *CgoBackend) GetNewMainchainAddress() common.Address {
 	cAddress := C.get_new_mainchain_address()
+	var address common.Address
 	for i, uchar := range cAddress.address {
-		addressBytes[i] = byte(uchar)
+		address[i] = byte(uchar)
 	}
-	return append(feeBytes, addressBytes...)
+	return address
 }
 
-func DecodeWithdrawal(value *big.Int, data []byte) (Withdrawal, error) {
-	if len(data) != 28 {
-		return Withdrawal{}, errors.New("wrong withdrawal data length")
-	}
-	feeBytes := data[0:8]
-	if len(feeBytes) != 8 {
-		panic("off by one error")
-	}
-	addressBytes := data[8:28]
-	if len(addressBytes) != 20 {
-		panic("off by one error")
-	}
-	var address [20]C.uchar
-	for i, byte := range addressBytes {
-		address[i] = C.uchar(byte)
-	}
-	// Convert Wei to Satoshi.
-	var amount big.Int
-	amount.Div(value, Satoshi)
-	fee := big.NewInt(int64(binary.BigEndian.Uint64(feeBytes)))
-	return Withdrawal{
-		Address: address,
-		Amount:  &amount,
-		Fee:     fee,
-	}, nil
-}
-
-func AttemptBundleBroadcast() bool {
+func (b *CgoBackend) AttemptBundleBroadcast() bool {
 	return bool(C.attempt_bundle_broadcast())
 }
 
-func attemptBmm(criticalHash string, prevMainBlockHash string, amount uint64) {
-	cCriticalHash := C.CString(criticalHash)
-	cPrevMainBlockHash := C.CString(prevMainBlockHash)
-	C.attempt_bmm(cCriticalHash, cPrevMainBlockHash, C.ulong(amount))
+func (b *CgoBackend) AttemptBmm(sessionID uint64, header *types.Header, amount uint64) {
+	cCriticalHash := C.CString(header.Hash().Hex()[2:])
+	cPrevMainBlockHash := C.CString(header.PrevMainBlockHash.Hex()[2:])
+	C.attempt_bmm(C.ulong(sessionID), cCriticalHash, cPrevMainBlockHash, C.ulong(amount))
 	C.free(unsafe.Pointer(cCriticalHash))
 	C.free(unsafe.Pointer(cPrevMainBlockHash))
 }
 
-func AttemptBmm(header *types.Header, amount uint64) {
-	attemptBmm(header.Hash().Hex()[2:], header.PrevMainBlockHash.Hex()[2:], amount)
+func (b *CgoBackend) ConfirmBmm(sessionID uint64) BmmState {
+	return BmmState(C.confirm_bmm(C.ulong(sessionID)))
 }
 
-type BmmState uint
-
-const (
-	Succeded BmmState = iota
-	Failed
-	Pending
-)
-
-func ConfirmBmm() BmmState {
-	return BmmState(C.confirm_bmm())
+// AbortBmm posts an abort to the Rust side for sessionID's attempt_bmm
+// call, so its pending Bitcoin transaction is unwound from the mempool
+// without affecting any other session's in-flight attempt.
+func (b *CgoBackend) AbortBmm(sessionID uint64) {
+	C.abort_bmm(C.ulong(sessionID))
 }
 
-func verifyBmm(mainBlockHash string, criticalHash string) bool {
-	cMainBlockHash := C.CString(mainBlockHash)
-	cCriticalHash := C.CString(criticalHash)
+func (b *CgoBackend) VerifyBmm(mainBlockHash common.Hash, criticalHash common.Hash) bool {
+	cMainBlockHash := C.CString(mainBlockHash.Hex()[2:])
+	cCriticalHash := C.CString(criticalHash.Hex()[2:])
 	result := bool(C.verify_bmm(cMainBlockHash, cCriticalHash))
 	C.free(unsafe.Pointer(cMainBlockHash))
 	C.free(unsafe.Pointer(cCriticalHash))
 	return result
 }
-
-func VerifyBmm(mainBlockHash common.Hash, criticalHash common.Hash) bool {
-	return verifyBmm(mainBlockHash.Hex()[2:], criticalHash.Hex()[2:])
-}
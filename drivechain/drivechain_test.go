@@ -0,0 +1,124 @@
+package drivechain_test
+
+import (
+	"math"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/skydogenet/ethereum-sidechain/drivechain"
+	"github.com/skydogenet/ethereum-sidechain/drivechain/simulated"
+)
+
+func TestDecodeWithdrawal(t *testing.T) {
+	tests := []struct {
+		name       string
+		fee        uint64
+		weiValue   *big.Int
+		wantAmount uint64
+		wantErr    bool
+	}{
+		{
+			name:       "round trips a typical withdrawal",
+			fee:        1_000,
+			weiValue:   new(big.Int).Mul(big.NewInt(5), big.NewInt(1e18)),
+			wantAmount: new(big.Int).Div(new(big.Int).Mul(big.NewInt(5), big.NewInt(1e18)), drivechain.Satoshi.ToBig()).Uint64(),
+		},
+		{
+			name:       "zero value withdrawal",
+			fee:        0,
+			weiValue:   big.NewInt(0),
+			wantAmount: 0,
+		},
+		{
+			name:     "value that overflows a uint64 satoshi amount is rejected",
+			fee:      1,
+			weiValue: new(big.Int).Mul(new(big.Int).Add(new(big.Int).SetUint64(math.MaxUint64), big.NewInt(1)), drivechain.Satoshi.ToBig()),
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := drivechain.SetBackend(simulated.NewBackend())
+			defer drivechain.SetBackend(previous)
+
+			// Drive the real GetWithdrawalData, which asks the backend for a
+			// fresh mainchain address, so this test catches drift between it
+			// and DecodeWithdrawal instead of asserting against a hand-rolled
+			// copy of the wire format.
+			data := drivechain.GetWithdrawalData(tt.fee)
+			wantAddress := common.BytesToAddress(data[8:28])
+
+			w, err := drivechain.DecodeWithdrawal(tt.weiValue, data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if w.MainchainAddress() != wantAddress {
+				t.Errorf("address = %s, want %s", w.MainchainAddress(), wantAddress)
+			}
+			if !w.Amount().IsUint64() || w.Amount().Uint64() != tt.wantAmount {
+				t.Errorf("amount = %s, want %d", w.Amount(), tt.wantAmount)
+			}
+			if w.Fee().Uint64() != tt.fee {
+				t.Errorf("fee = %s, want %d", w.Fee(), tt.fee)
+			}
+		})
+	}
+}
+
+func TestDecodeWithdrawalWrongLength(t *testing.T) {
+	if _, err := drivechain.DecodeWithdrawal(big.NewInt(0), []byte{1, 2, 3}); err == nil {
+		t.Fatal("expected an error for malformed withdrawal data")
+	}
+}
+
+// forkBackend embeds a simulated.Backend to satisfy drivechain.Backend and
+// overrides GetPrevMainBlockHash with an explicit prev-hash map, so
+// MainchainAncestor can be tested against diverging forks that
+// simulated.Backend's single linear mainchain can't represent.
+type forkBackend struct {
+	*simulated.Backend
+	prev map[common.Hash]common.Hash
+}
+
+func (b *forkBackend) GetPrevMainBlockHash(h common.Hash) common.Hash {
+	return b.prev[h]
+}
+
+func TestMainchainAncestor(t *testing.T) {
+	commonAncestor := common.HexToHash("0xc0")
+	a1 := common.HexToHash("0xa1")
+	a2 := common.HexToHash("0xa2")
+	b1 := common.HexToHash("0xb1")
+	b2 := common.HexToHash("0xb2")
+
+	previous := drivechain.SetBackend(&forkBackend{
+		Backend: simulated.NewBackend(),
+		prev: map[common.Hash]common.Hash{
+			a2: a1,
+			a1: commonAncestor,
+			b2: b1,
+			b1: commonAncestor,
+		},
+	})
+	defer drivechain.SetBackend(previous)
+
+	if got := drivechain.MainchainAncestor(a2, b2); got != commonAncestor {
+		t.Errorf("MainchainAncestor(a2, b2) = %s, want %s", got, commonAncestor)
+	}
+	if got := drivechain.MainchainAncestor(commonAncestor, a2); got != commonAncestor {
+		t.Errorf("MainchainAncestor(commonAncestor, a2) = %s, want %s (commonAncestor is already an ancestor of a2)", got, commonAncestor)
+	}
+
+	unrelated := common.HexToHash("0xdead")
+	if got := drivechain.MainchainAncestor(a2, unrelated); got != (common.Hash{}) {
+		t.Errorf("MainchainAncestor(a2, unrelated) = %s, want the zero hash (no common ancestor)", got)
+	}
+}
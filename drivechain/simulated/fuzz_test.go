@@ -0,0 +1,94 @@
+package simulated_test
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/holiman/uint256"
+
+	"github.com/skydogenet/ethereum-sidechain/drivechain"
+	"github.com/skydogenet/ethereum-sidechain/drivechain/simulated"
+)
+
+// FuzzConnectDisconnect fuzzes an interleaving of connects, rejected
+// non-tip disconnects, and successful tip disconnects against a simulated
+// backend, then rewinds whatever is left back to the first connected block
+// and checks the treasury invariant against what the backend itself
+// reports was reverted — not a self-maintained running total, which would
+// net to zero even if ConnectBlock/DisconnectBlock silently no-op'd.
+func FuzzConnectDisconnect(f *testing.F) {
+	f.Add([]byte{0, 2, 0, 3, 0, 1}, uint64(1_000_000))
+	f.Add([]byte{}, uint64(0))
+	f.Fuzz(func(t *testing.T, actions []byte, seedAmount uint64) {
+		if len(actions) > 64 {
+			actions = actions[:64]
+		}
+		backend := simulated.NewBackend()
+		depositAddress := common.BigToAddress(common.Big1)
+		amount := new(uint256.Int).SetUint64(seedAmount%1_000_000_000 + 1)
+
+		var connected []common.Hash
+		for i, action := range actions {
+			switch action % 4 {
+			case 2:
+				// Disconnecting anything but the tip must be rejected.
+				if len(connected) < 2 {
+					continue
+				}
+				nonTip := connected[0]
+				if err := backend.DisconnectBlock(nonTip); err == nil {
+					t.Fatalf("step %d: disconnecting non-tip block %s: expected an error", i, nonTip.Hex())
+				}
+			case 3:
+				// Disconnect the actual tip and check the backend forgets
+				// it.
+				if len(connected) == 0 {
+					continue
+				}
+				tip := connected[len(connected)-1]
+				if err := backend.DisconnectBlock(tip); err != nil {
+					t.Fatalf("step %d: disconnect tip %s: %v", i, tip.Hex(), err)
+				}
+				connected = connected[:len(connected)-1]
+				if len(connected) > 0 {
+					if got, want := backend.GetMainchainTip(), connected[len(connected)-1]; got != want {
+						t.Fatalf("step %d: tip after disconnect = %s, want %s", i, got, want)
+					}
+				}
+			default:
+				mainBlockHash := backend.MineMainchainBlock()
+				deposit := drivechain.Deposit{Address: depositAddress, Amount: amount}
+				if !backend.ConnectBlock(mainBlockHash, []drivechain.Deposit{deposit}, nil, nil, false) {
+					t.Fatalf("step %d: connect block failed", i)
+				}
+				connected = append(connected, mainBlockHash)
+			}
+		}
+		if len(connected) == 0 {
+			return
+		}
+
+		ancestor := connected[0]
+		deposits, _, _, err := backend.Rewind(ancestor)
+		if err != nil {
+			t.Fatalf("Rewind(%s): %v", ancestor.Hex(), err)
+		}
+		wantReverted := len(connected) - 1
+		if len(deposits) != wantReverted {
+			t.Fatalf("Rewind reverted %d deposits, want %d", len(deposits), wantReverted)
+		}
+		for _, d := range deposits {
+			if !d.Amount.Eq(amount) {
+				t.Fatalf("reverted deposit amount = %s, want %s", d.Amount, amount)
+			}
+		}
+		if tip := backend.GetMainchainTip(); tip != ancestor {
+			t.Fatalf("tip after Rewind = %s, want ancestor %s", tip, ancestor)
+		}
+
+		// Rewinding to a hash that was never connected must error.
+		if _, _, _, err := backend.Rewind(common.HexToHash("0xdead")); err == nil {
+			t.Fatal("Rewind to an unconnected hash: expected an error")
+		}
+	})
+}
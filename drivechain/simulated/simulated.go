@@ -0,0 +1,270 @@
+// Package simulated provides an in-memory drivechain.Backend, so that
+// packages built on top of the sidechain (the miner's BMM loop, the state
+// processor's deposit/withdrawal crediting) can be exercised in tests
+// without a live bitcoind.
+package simulated
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/holiman/uint256"
+
+	"github.com/skydogenet/ethereum-sidechain/drivechain"
+)
+
+var _ drivechain.Backend = (*Backend)(nil)
+
+// connectEntry is an undo record for a single ConnectBlock call, mirroring
+// CgoBackend's journal so DisconnectBlock/Rewind behave the same way
+// against both backends.
+type connectEntry struct {
+	mainBlockHash common.Hash
+	deposits      []drivechain.Deposit
+	withdrawals   map[common.Hash]drivechain.Withdrawal
+	refunds       []common.Hash
+}
+
+// Option configures a Backend at construction time.
+type Option func(*Backend)
+
+// WithInitialDeposits seeds the simulated mainchain with deposits that are
+// already confirmed, as if they had been mined before the backend started.
+func WithInitialDeposits(deposits ...drivechain.Deposit) Option {
+	return func(b *Backend) {
+		b.pendingDeposits = append(b.pendingDeposits, deposits...)
+	}
+}
+
+// WithBmmConfirmDelay sets how many ConfirmBmm polls of a BMM attempt return
+// Pending before it settles. A delay of 0 confirms on the first poll.
+func WithBmmConfirmDelay(n int) Option {
+	return func(b *Backend) {
+		b.bmmConfirmDelay = n
+	}
+}
+
+// Backend is an in-memory drivechain.Backend for tests. It keeps a mock
+// chain of mainchain block hashes and a log of deposits/withdrawals/refunds
+// instead of talking to a real bitcoind over RPC.
+type Backend struct {
+	mu sync.Mutex
+
+	mainchainHashes []common.Hash // index 0 is genesis
+
+	pendingDeposits []drivechain.Deposit
+	withdrawals     map[common.Hash]drivechain.Withdrawal
+	refunds         map[common.Hash]bool
+	journal         []connectEntry
+
+	bmmConfirmDelay int
+	bmmAttempts     map[uint64]*bmmAttempt
+
+	nextMainchainAddress int64
+}
+
+// bmmAttempt is the per-session state backing AttemptBmm/ConfirmBmm/AbortBmm,
+// keyed by session id so that concurrent sessions never observe or abort
+// each other's attempt.
+type bmmAttempt struct {
+	pollCount int
+}
+
+// NewBackend constructs a simulated Backend whose mainchain starts out at
+// genesis.
+func NewBackend(opts ...Option) *Backend {
+	b := &Backend{
+		mainchainHashes: []common.Hash{mainchainHashForHeight(0)},
+		withdrawals:     make(map[common.Hash]drivechain.Withdrawal),
+		refunds:         make(map[common.Hash]bool),
+		bmmAttempts:     make(map[uint64]*bmmAttempt),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+func mainchainHashForHeight(height int) common.Hash {
+	return common.BigToHash(big.NewInt(int64(height) + 1))
+}
+
+// MineMainchainBlock appends a new mainchain tip to the simulated chain, as
+// if bitcoind had mined a block, and returns its hash.
+func (b *Backend) MineMainchainBlock() common.Hash {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	hash := mainchainHashForHeight(len(b.mainchainHashes))
+	b.mainchainHashes = append(b.mainchainHashes, hash)
+	return hash
+}
+
+func (b *Backend) GetMainchainTip() common.Hash {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.mainchainHashes[len(b.mainchainHashes)-1]
+}
+
+func (b *Backend) GetPrevMainBlockHash(mainBlockHash common.Hash) common.Hash {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, h := range b.mainchainHashes {
+		if h == mainBlockHash && i > 0 {
+			return b.mainchainHashes[i-1]
+		}
+	}
+	return common.Hash{}
+}
+
+func (b *Backend) GetDepositOutputs() []drivechain.Deposit {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	deposits := b.pendingDeposits
+	b.pendingDeposits = nil
+	return deposits
+}
+
+func (b *Backend) ConnectBlock(mainBlockHash common.Hash, deposits []drivechain.Deposit, withdrawals map[common.Hash]drivechain.Withdrawal, refunds []common.Hash, justChecking bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if justChecking {
+		return true
+	}
+	for id, w := range withdrawals {
+		b.withdrawals[id] = w
+	}
+	for _, r := range refunds {
+		b.refunds[r] = true
+	}
+	withdrawalsCopy := make(map[common.Hash]drivechain.Withdrawal, len(withdrawals))
+	for id, w := range withdrawals {
+		withdrawalsCopy[id] = w
+	}
+	b.journal = append(b.journal, connectEntry{
+		mainBlockHash: mainBlockHash,
+		deposits:      append([]drivechain.Deposit(nil), deposits...),
+		withdrawals:   withdrawalsCopy,
+		refunds:       append([]common.Hash(nil), refunds...),
+	})
+	return true
+}
+
+// DisconnectBlock undoes the effects of a previously connected mainchain
+// block, mirroring CgoBackend's journal-popping behavior.
+func (b *Backend) DisconnectBlock(mainBlockHash common.Hash) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.journal) == 0 {
+		return fmt.Errorf("simulated: no connected block to disconnect")
+	}
+	top := b.journal[len(b.journal)-1]
+	if top.mainBlockHash != mainBlockHash {
+		return fmt.Errorf("simulated: %s is not the most recently connected block (%s is)", mainBlockHash.Hex(), top.mainBlockHash.Hex())
+	}
+	for id := range top.withdrawals {
+		delete(b.withdrawals, id)
+	}
+	for _, r := range top.refunds {
+		delete(b.refunds, r)
+	}
+	b.journal = b.journal[:len(b.journal)-1]
+	if len(b.mainchainHashes) > 1 && b.mainchainHashes[len(b.mainchainHashes)-1] == mainBlockHash {
+		b.mainchainHashes = b.mainchainHashes[:len(b.mainchainHashes)-1]
+	}
+	return nil
+}
+
+// Rewind disconnects blocks back to (but not including) ancestor, returning
+// the deposits, withdrawals, and refunds that were reverted along the way.
+//
+// Progress is tracked purely off the journal, mirroring CgoBackend.Rewind,
+// rather than GetMainchainTip, which only happens to stay in lockstep here
+// because DisconnectBlock trims mainchainHashes itself.
+func (b *Backend) Rewind(ancestor common.Hash) ([]drivechain.Deposit, map[common.Hash]drivechain.Withdrawal, []common.Hash, error) {
+	var (
+		deposits    []drivechain.Deposit
+		withdrawals = make(map[common.Hash]drivechain.Withdrawal)
+		refunds     []common.Hash
+	)
+	for {
+		b.mu.Lock()
+		if len(b.journal) == 0 {
+			b.mu.Unlock()
+			return nil, nil, nil, fmt.Errorf("simulated: %s is not an ancestor of the connected chain", ancestor.Hex())
+		}
+		entry := b.journal[len(b.journal)-1]
+		if entry.mainBlockHash == ancestor {
+			b.mu.Unlock()
+			return deposits, withdrawals, refunds, nil
+		}
+		b.mu.Unlock()
+
+		if err := b.DisconnectBlock(entry.mainBlockHash); err != nil {
+			return nil, nil, nil, err
+		}
+		deposits = append(deposits, entry.deposits...)
+		for id, w := range entry.withdrawals {
+			withdrawals[id] = w
+		}
+		refunds = append(refunds, entry.refunds...)
+	}
+}
+
+func (b *Backend) AttemptBmm(sessionID uint64, header *types.Header, amount uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bmmAttempts[sessionID] = &bmmAttempt{}
+}
+
+func (b *Backend) ConfirmBmm(sessionID uint64) drivechain.BmmState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	attempt, ok := b.bmmAttempts[sessionID]
+	if !ok {
+		return drivechain.Failed
+	}
+	if attempt.pollCount < b.bmmConfirmDelay {
+		attempt.pollCount++
+		return drivechain.Pending
+	}
+	delete(b.bmmAttempts, sessionID)
+	return drivechain.Succeded
+}
+
+func (b *Backend) AbortBmm(sessionID uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.bmmAttempts, sessionID)
+}
+
+func (b *Backend) VerifyBmm(mainBlockHash common.Hash, criticalHash common.Hash) bool {
+	return true
+}
+
+func (b *Backend) AttemptBundleBroadcast() bool {
+	return true
+}
+
+func (b *Backend) CreateDeposit(address common.Address, amount uint64, fee uint64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pendingDeposits = append(b.pendingDeposits, drivechain.Deposit{
+		Address: address,
+		Amount:  new(uint256.Int).SetUint64(amount),
+	})
+	return true
+}
+
+func (b *Backend) FormatDepositAddress(address string) string {
+	return "simulated-deposit:" + address
+}
+
+func (b *Backend) GetNewMainchainAddress() common.Address {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextMainchainAddress++
+	return common.BigToAddress(big.NewInt(b.nextMainchainAddress))
+}
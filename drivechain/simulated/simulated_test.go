@@ -0,0 +1,155 @@
+package simulated_test
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/holiman/uint256"
+
+	"github.com/skydogenet/ethereum-sidechain/drivechain"
+	"github.com/skydogenet/ethereum-sidechain/drivechain/simulated"
+)
+
+func TestBackendMainchainTip(t *testing.T) {
+	backend := simulated.NewBackend()
+	genesis := backend.GetMainchainTip()
+	mined := backend.MineMainchainBlock()
+	if backend.GetMainchainTip() != mined {
+		t.Fatalf("tip = %s, want newly mined block %s", backend.GetMainchainTip(), mined)
+	}
+	if backend.GetPrevMainBlockHash(mined) != genesis {
+		t.Fatalf("prev(mined) = %s, want genesis %s", backend.GetPrevMainBlockHash(mined), genesis)
+	}
+}
+
+func TestBackendRewind(t *testing.T) {
+	backend := simulated.NewBackend()
+	depositAddress := common.BigToAddress(common.Big1)
+
+	var hashes []common.Hash
+	for _, amount := range []uint64{10, 20, 30} {
+		h := backend.MineMainchainBlock()
+		deposit := drivechain.Deposit{Address: depositAddress, Amount: new(uint256.Int).SetUint64(amount)}
+		if !backend.ConnectBlock(h, []drivechain.Deposit{deposit}, nil, nil, false) {
+			t.Fatalf("connect block %s failed", h)
+		}
+		hashes = append(hashes, h)
+	}
+
+	ancestor := hashes[0]
+	deposits, withdrawals, refunds, err := backend.Rewind(ancestor)
+	if err != nil {
+		t.Fatalf("Rewind: %v", err)
+	}
+	if len(deposits) != 2 {
+		t.Fatalf("got %d reverted deposits, want 2", len(deposits))
+	}
+	// Reverted in LIFO order: block 3 (30) before block 2 (20).
+	if deposits[0].Amount.Uint64() != 30 || deposits[1].Amount.Uint64() != 20 {
+		t.Fatalf("reverted deposits = %v, want [30, 20]", deposits)
+	}
+	if len(withdrawals) != 0 || len(refunds) != 0 {
+		t.Fatalf("withdrawals/refunds = %v/%v, want none", withdrawals, refunds)
+	}
+	if tip := backend.GetMainchainTip(); tip != ancestor {
+		t.Fatalf("tip after Rewind = %s, want ancestor %s", tip, ancestor)
+	}
+
+	if _, _, _, err := backend.Rewind(common.HexToHash("0xdead")); err == nil {
+		t.Fatal("Rewind to an unconnected hash: expected an error")
+	}
+}
+
+func TestBackendWithInitialDeposits(t *testing.T) {
+	depositAddress := common.BigToAddress(common.Big1)
+	deposit := drivechain.Deposit{Address: depositAddress, Amount: new(uint256.Int).SetUint64(42)}
+	backend := simulated.NewBackend(simulated.WithInitialDeposits(deposit))
+
+	got := backend.GetDepositOutputs()
+	if len(got) != 1 || got[0].Address != depositAddress || got[0].Amount.Uint64() != 42 {
+		t.Fatalf("GetDepositOutputs = %+v, want [%+v]", got, deposit)
+	}
+	// GetDepositOutputs drains the queue; a second call must return none.
+	if got := backend.GetDepositOutputs(); len(got) != 0 {
+		t.Fatalf("second GetDepositOutputs = %+v, want none", got)
+	}
+}
+
+func TestBackendConfirmBmmDelay(t *testing.T) {
+	backend := simulated.NewBackend(simulated.WithBmmConfirmDelay(2))
+	backend.AttemptBmm(1, nil, 0)
+	for i := 0; i < 2; i++ {
+		if state := backend.ConfirmBmm(1); state != drivechain.Pending {
+			t.Fatalf("poll %d: state = %d, want Pending", i, state)
+		}
+	}
+	if state := backend.ConfirmBmm(1); state != drivechain.Succeded {
+		t.Fatalf("final poll: state = %d, want Succeded", state)
+	}
+}
+
+func TestBackendConfirmBmmSessionsAreIndependent(t *testing.T) {
+	backend := simulated.NewBackend(simulated.WithBmmConfirmDelay(1_000_000))
+	backend.AttemptBmm(1, nil, 0)
+	backend.AttemptBmm(2, nil, 0)
+
+	// Aborting session 1 must not affect session 2's in-flight attempt.
+	backend.AbortBmm(1)
+	if state := backend.ConfirmBmm(1); state != drivechain.Failed {
+		t.Fatalf("session 1 state = %d, want Failed after abort", state)
+	}
+	if state := backend.ConfirmBmm(2); state != drivechain.Pending {
+		t.Fatalf("session 2 state = %d, want Pending, unaffected by session 1's abort", state)
+	}
+}
+
+func TestStartBmmSucceeds(t *testing.T) {
+	previous := drivechain.SetBackend(simulated.NewBackend())
+	defer drivechain.SetBackend(previous)
+
+	session, err := drivechain.StartBmm(context.Background(), &types.Header{}, 0)
+	if err != nil {
+		t.Fatalf("StartBmm: %v", err)
+	}
+	if state := session.Wait(); state != drivechain.Succeded {
+		t.Fatalf("state = %d, want Succeded", state)
+	}
+}
+
+func TestStartBmmConcurrentSessionsSucceedIndependently(t *testing.T) {
+	previous := drivechain.SetBackend(simulated.NewBackend())
+	defer drivechain.SetBackend(previous)
+
+	stale, err := drivechain.StartBmm(context.Background(), &types.Header{}, 0)
+	if err != nil {
+		t.Fatalf("StartBmm (stale): %v", err)
+	}
+	fresh, err := drivechain.StartBmm(context.Background(), &types.Header{Number: big.NewInt(1)}, 0)
+	if err != nil {
+		t.Fatalf("StartBmm (fresh): %v", err)
+	}
+
+	if state := stale.Wait(); state != drivechain.Succeded {
+		t.Fatalf("stale session state = %d, want Succeded", state)
+	}
+	if state := fresh.Wait(); state != drivechain.Succeded {
+		t.Fatalf("fresh session state = %d, want Succeded", state)
+	}
+}
+
+func TestStartBmmCancel(t *testing.T) {
+	previous := drivechain.SetBackend(simulated.NewBackend(simulated.WithBmmConfirmDelay(1_000_000)))
+	defer drivechain.SetBackend(previous)
+
+	session, err := drivechain.StartBmm(context.Background(), &types.Header{}, 0)
+	if err != nil {
+		t.Fatalf("StartBmm: %v", err)
+	}
+	session.Cancel()
+	if state := session.Wait(); state != drivechain.Failed {
+		t.Fatalf("state = %d, want Failed", state)
+	}
+}